@@ -0,0 +1,80 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha1
+
+import "fmt"
+
+// ClusterProfile describes a single cluster participating in a multi-primary install driven
+// by one IstioOperator CR. It is read from spec.clusterProfiles[], a field the upstream
+// IstioOperatorSpec proto does not define, so it is parsed directly off the CR's unstructured
+// spec rather than requiring an istio.io/api schema change.
+type ClusterProfile struct {
+	// ClusterName identifies the cluster. kube.Cluster has no Name() accessor, so in test this
+	// must match whatever name the test itself assigned the cluster; at runtime it is the
+	// cluster registry key.
+	ClusterName string `json:"clusterName"`
+	// Network is the network ID assigned to workloads in this cluster.
+	Network string `json:"network"`
+	// MeshID is the shared mesh identifier across all clusterProfiles entries.
+	MeshID string `json:"meshID"`
+	// KubeconfigSecret names the Secret in the operator's namespace holding the
+	// kubeconfig used to reach this cluster.
+	KubeconfigSecret string `json:"kubeconfigSecret"`
+}
+
+// ClusterProfilesFromSpec extracts spec.clusterProfiles[] from an IstioOperator CR's
+// unstructured spec map. It returns an empty slice, not an error, when the field is absent so
+// single-cluster installs are unaffected.
+func ClusterProfilesFromSpec(spec map[string]interface{}) ([]ClusterProfile, error) {
+	raw, ok := spec["clusterProfiles"]
+	if !ok {
+		return nil, nil
+	}
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("spec.clusterProfiles must be a list, got %T", raw)
+	}
+	profiles := make([]ClusterProfile, 0, len(items))
+	for i, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("spec.clusterProfiles[%d] must be an object, got %T", i, item)
+		}
+		p := ClusterProfile{
+			ClusterName:      stringField(m, "clusterName"),
+			Network:          stringField(m, "network"),
+			MeshID:           stringField(m, "meshID"),
+			KubeconfigSecret: stringField(m, "kubeconfigSecret"),
+		}
+		if p.ClusterName == "" {
+			return nil, fmt.Errorf("spec.clusterProfiles[%d].clusterName is required", i)
+		}
+		if p.Network == "" {
+			return nil, fmt.Errorf("spec.clusterProfiles[%d].network is required", i)
+		}
+		if p.MeshID == "" {
+			return nil, fmt.Errorf("spec.clusterProfiles[%d].meshID is required", i)
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+func stringField(m map[string]interface{}, key string) string {
+	if v, ok := m[key].(string); ok {
+		return v
+	}
+	return ""
+}
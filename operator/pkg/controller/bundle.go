@@ -0,0 +1,194 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"istio.io/istio/operator/pkg/object"
+)
+
+// BundleArtifact is a single sha256-pinned artifact referenced from a BundleManifest: either a
+// chart directory (fetched and rendered in place of manifests/) or a component image reference,
+// which is pulled by kubelet against its own registry digest and so carries no local pin.
+type BundleArtifact struct {
+	URL    string `yaml:"url"`
+	SHA256 string `yaml:"sha256,omitempty"`
+}
+
+// BundleManifest is the structure spec.bundleManifest points at: a small YAML file pinning
+// exact chart and image versions so operators can declare them without maintaining a fork of
+// manifests/. Component names match the keys manifests/ uses today (base, pilot, the two
+// gateway charts, cni, operator).
+type BundleManifest struct {
+	Charts map[string]BundleArtifact `yaml:"charts"`
+	Images map[string]BundleArtifact `yaml:"images"`
+}
+
+// ChartRenderer renders a verified chart directory (as returned by FetchChart) into the k8s
+// objects it produces for iop, the same role manifests/ rendering plays for installPackagePath.
+// This package declares the interface only and contains no implementation of it.
+type ChartRenderer interface {
+	Render(component, chartDir string, iop *unstructured.Unstructured) (object.K8sObjects, error)
+}
+
+// LoadBundleManifest reads and parses a BundleManifest from path (itself a plain local file,
+// regardless of what scheme its artifacts' URLs use).
+func LoadBundleManifest(path string) (*BundleManifest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle manifest %s: %v", path, err)
+	}
+	bm := &BundleManifest{}
+	if err := yaml.Unmarshal(raw, bm); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle manifest %s: %v", path, err)
+	}
+	return bm, nil
+}
+
+// FetchChart resolves a chart artifact's URL to a local chart directory and verifies every file
+// under it against the pinned sha256 digest, returning the directory on success. A chart is a
+// tree of files (Chart.yaml, templates/, values.yaml, ...), not a single blob, so unlike an
+// image reference it can only be verified and rendered as a directory; only local file:// chart
+// directories are supported today, the same way the bundle manifest test constructs them.
+func FetchChart(a BundleArtifact) (string, error) {
+	dir, err := localChartDir(a.URL)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyChartDigest(a, dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func localChartDir(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid chart url %q: %v", rawURL, err)
+	}
+	switch u.Scheme {
+	case "file", "":
+		return u.Path, nil
+	default:
+		return "", fmt.Errorf("unsupported chart url scheme %q in %s: only local file:// chart directories are supported", u.Scheme, rawURL)
+	}
+}
+
+// verifyChartDigest checks dir's content against the artifact's pinned sha256, computed over
+// every file's relative path and content so any addition, removal, or edit under dir is caught.
+func verifyChartDigest(a BundleArtifact, dir string) error {
+	if a.SHA256 == "" {
+		return fmt.Errorf("chart artifact %s has no sha256 pin", a.URL)
+	}
+	got, err := digestChartDir(dir)
+	if err != nil {
+		return err
+	}
+	if got != a.SHA256 {
+		return fmt.Errorf("chart artifact %s failed sha256 verification: want %s, got %s", a.URL, a.SHA256, got)
+	}
+	return nil
+}
+
+// digestChartDir computes a deterministic sha256 over dir's file tree: every regular file's
+// path relative to dir, followed by its content, in sorted path order.
+func digestChartDir(dir string) (string, error) {
+	var relPaths []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		relPaths = append(relPaths, rel)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to walk chart directory %s: %v", dir, err)
+	}
+	sort.Strings(relPaths)
+
+	h := sha256.New()
+	for _, rel := range relPaths {
+		content, err := ioutil.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s to compute chart digest: %v", rel, err)
+		}
+		h.Write([]byte(rel))
+		h.Write(content)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// RenderBundleManifest loads the BundleManifest at path, fetches and verifies every chart it
+// pins, and renders each through chartRenderer, returning the combined objects. This is the one
+// fetch/verify/render implementation for spec.bundleManifest in this package; its caller here is
+// Reconciler (the controller's watch loop). No istioctl command in this checkout calls it.
+func RenderBundleManifest(path string, chartRenderer ChartRenderer, iop *unstructured.Unstructured) (object.K8sObjects, error) {
+	if chartRenderer == nil {
+		return nil, fmt.Errorf("spec.bundleManifest is set but no ChartRenderer was configured")
+	}
+	bm, err := LoadBundleManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	var objs object.K8sObjects
+	for component, artifact := range bm.Charts {
+		chartDir, err := FetchChart(artifact)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch bundle chart %s: %v", component, err)
+		}
+		rendered, err := chartRenderer.Render(component, chartDir, iop)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render bundle chart %s: %v", component, err)
+		}
+		objs = append(objs, rendered...)
+	}
+	return objs, nil
+}
+
+// PinChartDir computes the BundleArtifact for a local chart directory, digesting its actual
+// content. Used by tooling (and tests) that construct a BundleManifest pointing at a chart
+// already on disk, rather than hand-typing a digest that would silently stop matching the chart
+// on its next edit.
+func PinChartDir(dir string) (BundleArtifact, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return BundleArtifact{}, fmt.Errorf("failed to resolve absolute path for %s: %v", dir, err)
+	}
+	digest, err := digestChartDir(abs)
+	if err != nil {
+		return BundleArtifact{}, fmt.Errorf("failed to digest chart directory %s: %v", dir, err)
+	}
+	u := url.URL{Scheme: "file", Path: abs}
+	return BundleArtifact{URL: u.String(), SHA256: digest}, nil
+}
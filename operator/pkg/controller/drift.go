@@ -0,0 +1,91 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+
+	"istio.io/istio/operator/pkg/object"
+)
+
+// DriftEntry describes one live object that no longer matches the generated manifest, surfaced
+// under status.drift[] on the IstioOperator CR.
+type DriftEntry struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Field     string `json:"field"`
+	Want      string `json:"want"`
+	Got       string `json:"got"`
+}
+
+// ReconcileDrift checks every generated object of a known kind against the live cluster. A
+// generated object that is missing live is returned as a DriftEntry for status.drift[]. For
+// Deployments, spec.replicas (the common source of out-of-band drift from manual kubectl scale
+// or an HPA fighting the install) is compared and, when it differs, reverted in place. No other
+// field of any object is compared, so other live edits are neither reverted nor reported.
+func ReconcileDrift(ctx context.Context, dyn dynamic.Interface, generated object.K8sObjects) ([]DriftEntry, error) {
+	var drift []DriftEntry
+	for _, gen := range generated {
+		gvr, ok := gvrForKind(gen.Kind)
+		if !ok {
+			continue
+		}
+		live, err := dyn.Resource(gvr).Namespace(gen.Namespace).Get(ctx, gen.Name, metav1.GetOptions{})
+		if err != nil {
+			if isNotFound(err) {
+				drift = append(drift, DriftEntry{
+					Kind: gen.Kind, Namespace: gen.Namespace, Name: gen.Name,
+					Field: "<object>", Want: "present", Got: "missing",
+				})
+				continue
+			}
+			return nil, fmt.Errorf("failed to get live %s %s/%s: %v", gen.Kind, gen.Namespace, gen.Name, err)
+		}
+
+		if gen.Kind != "Deployment" {
+			continue
+		}
+		wantReplicas, ok := nestedInt64(gen.UnstructuredObject().Object, "spec", "replicas")
+		if !ok {
+			continue
+		}
+		gotReplicas, ok := nestedInt64(live.Object, "spec", "replicas")
+		if !ok || gotReplicas == wantReplicas {
+			continue
+		}
+
+		if err := unstructured.SetNestedField(live.Object, wantReplicas, "spec", "replicas"); err != nil {
+			return nil, fmt.Errorf("failed to revert replicas on %s/%s: %v", gen.Namespace, gen.Name, err)
+		}
+		if _, err := dyn.Resource(gvr).Namespace(gen.Namespace).Update(ctx, live, metav1.UpdateOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to revert drift on %s/%s: %v", gen.Namespace, gen.Name, err)
+		}
+	}
+	return drift, nil
+}
+
+func nestedInt64(obj map[string]interface{}, fields ...string) (int64, bool) {
+	v, ok, err := unstructured.NestedInt64(obj, fields...)
+	if err != nil || !ok {
+		return 0, false
+	}
+	return v, true
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	api "istio.io/api/operator/v1alpha1"
+	iopv1alpha1 "istio.io/istio/operator/pkg/apis/istio/v1alpha1"
+	"istio.io/istio/operator/pkg/object"
+)
+
+// ClusterStatus rolls up installation status for one cluster in a multi-primary install. It is
+// persisted under status.clusterStatus on the IstioOperator CR, alongside the proto-defined
+// top-level InstallStatus rather than inside it, so multi-cluster support does not require a
+// schema change to the upstream istio.io/api InstallStatus message.
+type ClusterStatus struct {
+	Status          api.InstallStatus_Status                    `json:"status"`
+	ComponentStatus map[string]*api.InstallStatus_VersionStatus `json:"componentStatus,omitempty"`
+}
+
+// ClusterInstaller installs and reports status for a single cluster. This package declares the
+// interface only and contains no implementation of it; Reconciler and ReconcileMultiPrimary call
+// whatever implementation they are given.
+type ClusterInstaller interface {
+	// InstallAndStatus applies iop to the named cluster and returns its rolled-up status
+	// together with the objects it actually applied (objs itself when non-nil, or whatever it
+	// rendered from manifests/ otherwise) so the caller can record ownership and detect drift
+	// without needing to re-render the manifest itself. objs, when non-nil, is a pre-rendered
+	// manifest (e.g. from spec.bundleManifest) that the installer must apply instead of
+	// rendering iop from manifests/ itself.
+	InstallAndStatus(ctx context.Context, clusterName string, iop *unstructured.Unstructured,
+		objs object.K8sObjects) (*ClusterStatus, object.K8sObjects, error)
+}
+
+// ReconcileMultiPrimary fans an IstioOperator install out across every cluster listed in
+// spec.clusterProfiles, installs into each via installer, and patches the aggregated result
+// back onto status.clusterStatus. It returns the per-cluster results it wrote, together with
+// every object actually applied across all clusters (deduplicated by kind/namespace/name) so the
+// caller can run ownership/drift tracking the same way it does for a single-cluster install. objs
+// is forwarded to installer unchanged; see ClusterInstaller.InstallAndStatus.
+func ReconcileMultiPrimary(ctx context.Context, dyn dynamic.Interface, gvr schema.GroupVersionResource,
+	iop *unstructured.Unstructured, installer ClusterInstaller, objs object.K8sObjects) (map[string]*ClusterStatus, object.K8sObjects, error) {
+	spec, ok := iop.Object["spec"].(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("IstioOperator %s/%s has no spec", iop.GetNamespace(), iop.GetName())
+	}
+	profiles, err := iopv1alpha1.ClusterProfilesFromSpec(spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse spec.clusterProfiles: %v", err)
+	}
+
+	result := make(map[string]*ClusterStatus, len(profiles))
+	var applied object.K8sObjects
+	seen := map[string]bool{}
+	for _, p := range profiles {
+		cStatus, cApplied, err := installer.InstallAndStatus(ctx, p.ClusterName, iop, objs)
+		if err != nil {
+			cStatus = &ClusterStatus{Status: api.InstallStatus_ERROR}
+		}
+		result[p.ClusterName] = cStatus
+		for _, o := range cApplied {
+			key := o.Kind + "/" + o.Namespace + "/" + o.Name
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			applied = append(applied, o)
+		}
+	}
+
+	if err := patchClusterStatus(ctx, dyn, gvr, iop, result); err != nil {
+		return result, applied, fmt.Errorf("failed to patch status.clusterStatus: %v", err)
+	}
+	return result, applied, nil
+}
+
+// patchClusterStatus writes the aggregated per-cluster status map to status.clusterStatus via
+// the status subresource, converting ClusterStatus to a plain map so it round-trips through
+// unstructured JSON without needing generated proto accessors.
+func patchClusterStatus(ctx context.Context, dyn dynamic.Interface, gvr schema.GroupVersionResource,
+	iop *unstructured.Unstructured, clusterStatus map[string]*ClusterStatus) error {
+	current, err := dyn.Resource(gvr).Namespace(iop.GetNamespace()).Get(ctx, iop.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	status, ok := current.Object["status"].(map[string]interface{})
+	if !ok {
+		status = map[string]interface{}{}
+	}
+	cs := make(map[string]interface{}, len(clusterStatus))
+	for name, s := range clusterStatus {
+		components := make(map[string]interface{}, len(s.ComponentStatus))
+		for cn, vs := range s.ComponentStatus {
+			components[cn] = map[string]interface{}{"status": vs.Status.String()}
+		}
+		cs[name] = map[string]interface{}{
+			"status":          s.Status.String(),
+			"componentStatus": components,
+		}
+	}
+	status["clusterStatus"] = cs
+	current.Object["status"] = status
+	_, err = dyn.Resource(gvr).Namespace(iop.GetNamespace()).UpdateStatus(ctx, current, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/operator/pkg/object"
+	"istio.io/pkg/log"
+)
+
+// IstioOperatorGVR addresses the IstioOperator CRD that Reconciler watches.
+var IstioOperatorGVR = schema.GroupVersionResource{
+	Group:    "install.istio.io",
+	Version:  "v1alpha1",
+	Resource: "istiooperators",
+}
+
+// resyncPeriod is how often the informer replays every known IstioOperator CR through Reconcile
+// even without an apiserver change, which is what lets out-of-band drift get noticed.
+const resyncPeriod = 30 * time.Second
+
+// Reconciler is the watch loop every reconcile function in this package is an entry point for:
+// it watches IstioOperator CRs and, for each one, fans out to ReconcileMultiPrimary when
+// spec.clusterProfiles is set or to installer otherwise. The ClusterInstaller and ChartRenderer
+// it uses are supplied by the caller of NewReconciler.
+type Reconciler struct {
+	dyn           dynamic.Interface
+	installer     ClusterInstaller
+	chartRenderer ChartRenderer
+}
+
+// NewReconciler builds a Reconciler that reconciles IstioOperator CRs visible through dyn,
+// installing via installer. chartRenderer is only needed by CRs that set spec.bundleManifest;
+// it may be nil otherwise.
+func NewReconciler(dyn dynamic.Interface, installer ClusterInstaller, chartRenderer ChartRenderer) *Reconciler {
+	return &Reconciler{dyn: dyn, installer: installer, chartRenderer: chartRenderer}
+}
+
+// Start runs the watch loop until ctx is cancelled.
+func (r *Reconciler) Start(ctx context.Context) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(r.dyn, resyncPeriod)
+	informer := factory.ForResource(IstioOperatorGVR).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { r.handle(ctx, obj) },
+		UpdateFunc: func(_, obj interface{}) { r.handle(ctx, obj) },
+	})
+	informer.Run(ctx.Done())
+}
+
+func (r *Reconciler) handle(ctx context.Context, obj interface{}) {
+	iop, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	spec, _ := iop.Object["spec"].(map[string]interface{})
+	uninstallRequested, _ := spec["uninstall"].(bool)
+	if iop.GetDeletionTimestamp() != nil || uninstallRequested {
+		if err := r.reconcileUninstall(ctx, iop.GetNamespace(), iop.GetName()); err != nil {
+			log.Errorf("failed to uninstall IstioOperator %s/%s: %v", iop.GetNamespace(), iop.GetName(), err)
+		}
+		return
+	}
+	if err := r.Reconcile(ctx, iop); err != nil {
+		log.Errorf("failed to reconcile IstioOperator %s/%s: %v", iop.GetNamespace(), iop.GetName(), err)
+	}
+}
+
+// Reconcile renders spec.bundleManifest when set, then installs iop, fanning the install out
+// across spec.clusterProfiles via ReconcileMultiPrimary when that field is set or installing to
+// the local cluster through installer otherwise, reconciles spec.tag against the revision's
+// webhook selector, and finally records ownership and reverts/surfaces drift against whatever was
+// applied (merged across every cluster for a multi-primary install). It does not handle
+// deletion/spec.uninstall; see reconcileUninstall.
+func (r *Reconciler) Reconcile(ctx context.Context, iop *unstructured.Unstructured) error {
+	spec, _ := iop.Object["spec"].(map[string]interface{})
+
+	objs, err := r.renderBundleManifest(spec, iop)
+	if err != nil {
+		return err
+	}
+
+	var appliedObjs object.K8sObjects
+	if _, ok := spec["clusterProfiles"]; ok {
+		_, applied, err := ReconcileMultiPrimary(ctx, r.dyn, IstioOperatorGVR, iop, r.installer, objs)
+		if err != nil {
+			return err
+		}
+		appliedObjs = applied
+	} else {
+		_, applied, err := r.installer.InstallAndStatus(ctx, "", iop, objs)
+		if err != nil {
+			return err
+		}
+		appliedObjs = applied
+	}
+	if err := ReconcileTag(ctx, r.dyn, iop); err != nil {
+		return err
+	}
+	if appliedObjs == nil {
+		return nil
+	}
+	return r.reconcileOwnershipAndDrift(ctx, iop, appliedObjs)
+}
+
+// reconcileOwnershipAndDrift records applied as the owned-resources inventory (so a later
+// deletion knows what to tear down), diffs it against the live cluster via ReconcileDrift, and
+// persists both the updated annotation and status.drift back onto the CR.
+func (r *Reconciler) reconcileOwnershipAndDrift(ctx context.Context, iop *unstructured.Unstructured, applied object.K8sObjects) error {
+	current, err := r.dyn.Resource(IstioOperatorGVR).Namespace(iop.GetNamespace()).Get(ctx, iop.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to re-fetch IstioOperator %s/%s: %v", iop.GetNamespace(), iop.GetName(), err)
+	}
+	if err := RecordOwnedResources(current, applied); err != nil {
+		return err
+	}
+	finalizers := current.GetFinalizers()
+	if !hasFinalizer(finalizers, Finalizer) {
+		current.SetFinalizers(append(finalizers, Finalizer))
+	}
+	updated, err := r.dyn.Resource(IstioOperatorGVR).Namespace(current.GetNamespace()).Update(ctx, current, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to persist owned-resources inventory: %v", err)
+	}
+	current = updated
+
+	drift, err := ReconcileDrift(ctx, r.dyn, applied)
+	if err != nil {
+		return err
+	}
+	return patchDrift(ctx, r.dyn, current, drift)
+}
+
+// reconcileUninstall tears down every resource IstioOperator name owns (per the owned-resources
+// inventory annotation) and removes Finalizer so the apiserver can finish deleting the CR. It is
+// driven from both a CR deletionTimestamp and an explicit spec.uninstall: true.
+func (r *Reconciler) reconcileUninstall(ctx context.Context, namespace, name string) error {
+	current, err := r.dyn.Resource(IstioOperatorGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	spec, _ := current.Object["spec"].(map[string]interface{})
+	preserveCRDs, _ := spec["preserveCRDs"].(bool)
+	if err := Uninstall(ctx, r.dyn, current, preserveCRDs); err != nil {
+		return err
+	}
+	_, err = r.dyn.Resource(IstioOperatorGVR).Namespace(namespace).Update(ctx, current, metav1.UpdateOptions{})
+	return err
+}
+
+func hasFinalizer(finalizers []string, want string) bool {
+	for _, f := range finalizers {
+		if f == want {
+			return true
+		}
+	}
+	return false
+}
+
+// patchDrift writes drift to status.drift via the status subresource on current, the
+// freshly-updated object reconcileOwnershipAndDrift just got back from its own Update call.
+func patchDrift(ctx context.Context, dyn dynamic.Interface, current *unstructured.Unstructured, drift []DriftEntry) error {
+	entries := make([]interface{}, 0, len(drift))
+	for _, d := range drift {
+		entries = append(entries, map[string]interface{}{
+			"kind": d.Kind, "namespace": d.Namespace, "name": d.Name,
+			"field": d.Field, "want": d.Want, "got": d.Got,
+		})
+	}
+	status, ok := current.Object["status"].(map[string]interface{})
+	if !ok {
+		status = map[string]interface{}{}
+	}
+	status["drift"] = entries
+	current.Object["status"] = status
+	_, err := dyn.Resource(IstioOperatorGVR).Namespace(current.GetNamespace()).UpdateStatus(ctx, current, metav1.UpdateOptions{})
+	return err
+}
+
+// renderBundleManifest renders every chart pinned by spec.bundleManifest via RenderBundleManifest,
+// returning the combined objects so the installer applies them instead of rendering iop from
+// manifests/. It returns a nil K8sObjects, not an error, when spec.bundleManifest is unset, so
+// the installer falls back to its normal manifests/ rendering.
+func (r *Reconciler) renderBundleManifest(spec map[string]interface{}, iop *unstructured.Unstructured) (object.K8sObjects, error) {
+	path, _ := spec["bundleManifest"].(string)
+	if path == "" {
+		return nil, nil
+	}
+	return RenderBundleManifest(path, r.chartRenderer, iop)
+}
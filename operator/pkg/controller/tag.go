@@ -0,0 +1,135 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// RevisionLabel is the pod/namespace label selector key istiod's MutatingWebhookConfiguration
+// objects use to route sidecar injection to a specific control plane revision.
+const RevisionLabel = "istio.io/rev"
+
+var mutatingWebhookGVR = schema.GroupVersionResource{
+	Group:    "admissionregistration.k8s.io",
+	Version:  "v1",
+	Resource: "mutatingwebhookconfigurations",
+}
+
+// ReconcileTag reconciles spec.tag on an IstioOperator CR: when set, it points the revision
+// tag's MutatingWebhookConfiguration (named "istio-revision-tag-<tag>") at the CR's
+// spec.revision, so that workloads pick up the new revision on restart without any change to
+// the workloads themselves. Promoting/demoting a revision is then just a matter of moving
+// spec.tag from one IstioOperator CR to another via `kubectl apply`; ReconcileTag only ever
+// touches the webhook selector, never the workloads, so it needs no client-go kubernetes client.
+func ReconcileTag(ctx context.Context, dyn dynamicInterface, iop *unstructured.Unstructured) error {
+	spec, ok := iop.Object["spec"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	tag, _ := spec["tag"].(string)
+	if tag == "" {
+		// No tag requested for this CR; nothing to reconcile.
+		return nil
+	}
+	revision, _ := spec["revision"].(string)
+	if revision == "" {
+		return fmt.Errorf("spec.tag %q requires spec.revision to be set", tag)
+	}
+
+	webhookName := "istio-revision-tag-" + tag
+	webhook, err := dyn.Resource(mutatingWebhookGVR).Get(ctx, webhookName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return createTagWebhook(ctx, dyn, webhookName, revision)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get MutatingWebhookConfiguration %s: %v", webhookName, err)
+	}
+	if err := setWebhookRevisionSelector(webhook, revision); err != nil {
+		return fmt.Errorf("failed to set revision selector on %s: %v", webhookName, err)
+	}
+	_, err = dyn.Resource(mutatingWebhookGVR).Update(ctx, webhook, metav1.UpdateOptions{})
+	return err
+}
+
+// createTagWebhook creates webhookName the first time spec.tag names a tag that has never been
+// reconciled before, by copying the revision's own sidecar-injector webhook (istiod creates one
+// named "istio-sidecar-injector-<revision>" per revision) and relabelling its selectors to
+// revision. Copying rather than hand-authoring the webhook spec keeps the tag webhook's
+// clientConfig/failurePolicy/rules in lockstep with whatever istiod actually registered.
+func createTagWebhook(ctx context.Context, dyn dynamicInterface, webhookName, revision string) error {
+	revisionWebhookName := "istio-sidecar-injector-" + revision
+	base, err := dyn.Resource(mutatingWebhookGVR).Get(ctx, revisionWebhookName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get revision webhook %s to seed tag webhook %s: %v", revisionWebhookName, webhookName, err)
+	}
+	tagWebhook := base.DeepCopy()
+	tagWebhook.SetName(webhookName)
+	tagWebhook.SetResourceVersion("")
+	tagWebhook.SetUID("")
+	tagWebhook.SetOwnerReferences(nil)
+	if err := setWebhookRevisionSelector(tagWebhook, revision); err != nil {
+		return fmt.Errorf("failed to set revision selector on %s: %v", webhookName, err)
+	}
+	_, err = dyn.Resource(mutatingWebhookGVR).Create(ctx, tagWebhook, metav1.CreateOptions{})
+	return err
+}
+
+// dynamicInterface is the subset of dynamic.Interface ReconcileTag needs: only Resource, with
+// dynamic.Interface's own return type, so a real dynamic.Interface satisfies this without an
+// adapter.
+type dynamicInterface interface {
+	Resource(gvr schema.GroupVersionResource) dynamic.NamespaceableResourceInterface
+}
+
+// setWebhookRevisionSelector rewrites every webhook entry's namespaceSelector/objectSelector
+// match expression for RevisionLabel to select the given revision.
+func setWebhookRevisionSelector(webhook *unstructured.Unstructured, revision string) error {
+	webhooks, ok := webhook.Object["webhooks"].([]interface{})
+	if !ok {
+		return fmt.Errorf("malformed MutatingWebhookConfiguration: no webhooks[]")
+	}
+	for _, w := range webhooks {
+		wh, ok := w.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, selectorKey := range []string{"namespaceSelector", "objectSelector"} {
+			selector, ok := wh[selectorKey].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			exprs, ok := selector["matchExpressions"].([]interface{})
+			if !ok {
+				continue
+			}
+			for _, e := range exprs {
+				expr, ok := e.(map[string]interface{})
+				if !ok || expr["key"] != RevisionLabel {
+					continue
+				}
+				expr["values"] = []interface{}{revision}
+			}
+		}
+	}
+	return nil
+}
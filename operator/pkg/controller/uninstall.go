@@ -0,0 +1,217 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"istio.io/istio/operator/pkg/object"
+)
+
+// OwnedResourcesAnnotation records the full inventory of objects a controller installed for a
+// given IstioOperator CR, so teardown can enumerate and delete them without needing to re-render
+// the manifest (which may no longer be possible once spec.installPackagePath/bundleManifest has
+// been removed or the CR is mid-deletion).
+const OwnedResourcesAnnotation = "install.istio.io/owned-resources"
+
+// Finalizer blocks apiserver deletion of the IstioOperator CR until Uninstall has confirmed
+// every owned resource is gone.
+const Finalizer = "istio-operator.install.istio.io/uninstall"
+
+// pruneOrder lists the kinds PruneOwnedResources deletes in, front to back: webhooks first so
+// nothing new gets admitted mid-teardown, then workloads, then RBAC, with CRDs last (and
+// skippable) since deleting them cascades to every instance of that CRD's type.
+var pruneOrder = []string{
+	"MutatingWebhookConfiguration",
+	"ValidatingWebhookConfiguration",
+	"EnvoyFilter",
+	"Deployment",
+	"Service",
+	"HorizontalPodAutoscaler",
+	"PodDisruptionBudget",
+	"ConfigMap",
+	"ServiceAccount",
+	"ClusterRoleBinding",
+	"ClusterRole",
+	"RoleBinding",
+	"Role",
+	"CustomResourceDefinition",
+}
+
+// OwnedResourceRef is one entry in the owned-resources inventory: enough to address the object
+// for deletion without needing its full manifest.
+type OwnedResourceRef struct {
+	Group     string `json:"group"`
+	Version   string `json:"version"`
+	Resource  string `json:"resource"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// RecordOwnedResources serializes objs into the owned-resources inventory annotation so a later
+// Uninstall (potentially after installPackagePath/bundleManifest has changed) knows exactly what
+// to delete.
+func RecordOwnedResources(iop *unstructured.Unstructured, objs object.K8sObjects) error {
+	refs := make([]OwnedResourceRef, 0, len(objs))
+	for _, o := range objs {
+		gvr, ok := gvrForKind(o.Kind)
+		if !ok {
+			continue
+		}
+		refs = append(refs, OwnedResourceRef{
+			Group:     gvr.Group,
+			Version:   gvr.Version,
+			Resource:  gvr.Resource,
+			Kind:      o.Kind,
+			Namespace: o.Namespace,
+			Name:      o.Name,
+		})
+	}
+	encoded, err := json.Marshal(refs)
+	if err != nil {
+		return fmt.Errorf("failed to encode owned-resources inventory: %v", err)
+	}
+	annotations := iop.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[OwnedResourcesAnnotation] = string(encoded)
+	iop.SetAnnotations(annotations)
+	return nil
+}
+
+// Uninstall deletes every resource recorded in the owned-resources inventory annotation, in
+// pruneOrder, optionally preserving CustomResourceDefinitions, then removes Finalizer so the
+// apiserver can finish deleting the CR. It is safe to call repeatedly (e.g. on every reconcile
+// while the CR has a deletionTimestamp) until it returns no error.
+func Uninstall(ctx context.Context, dyn dynamic.Interface, iop *unstructured.Unstructured, preserveCRDs bool) error {
+	refs, err := ownedResources(iop)
+	if err != nil {
+		return err
+	}
+
+	byKind := map[string][]OwnedResourceRef{}
+	for _, ref := range refs {
+		byKind[ref.Kind] = append(byKind[ref.Kind], ref)
+	}
+
+	for _, kind := range pruneOrder {
+		if kind == "CustomResourceDefinition" && preserveCRDs {
+			continue
+		}
+		for _, ref := range byKind[kind] {
+			gvr := schema.GroupVersionResource{Group: ref.Group, Version: ref.Version, Resource: ref.Resource}
+			resourceClient := dyn.Resource(gvr).Namespace(ref.Namespace)
+			if err := resourceClient.Delete(ctx, ref.Name, metav1.DeleteOptions{}); err != nil && !isNotFound(err) {
+				return fmt.Errorf("failed to delete %s %s/%s: %v", ref.Kind, ref.Namespace, ref.Name, err)
+			}
+		}
+	}
+
+	remaining, err := countRemaining(ctx, dyn, refs, preserveCRDs)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d owned resource(s) still exist, not removing finalizer yet", remaining)
+	}
+
+	finalizers := iop.GetFinalizers()
+	out := finalizers[:0]
+	for _, f := range finalizers {
+		if f != Finalizer {
+			out = append(out, f)
+		}
+	}
+	iop.SetFinalizers(out)
+	return nil
+}
+
+func countRemaining(ctx context.Context, dyn dynamic.Interface, refs []OwnedResourceRef, preserveCRDs bool) (int, error) {
+	remaining := 0
+	for _, ref := range refs {
+		if ref.Kind == "CustomResourceDefinition" && preserveCRDs {
+			continue
+		}
+		gvr := schema.GroupVersionResource{Group: ref.Group, Version: ref.Version, Resource: ref.Resource}
+		_, err := dyn.Resource(gvr).Namespace(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err == nil {
+			remaining++
+		} else if !isNotFound(err) {
+			return 0, fmt.Errorf("failed to check %s %s/%s: %v", ref.Kind, ref.Namespace, ref.Name, err)
+		}
+	}
+	return remaining, nil
+}
+
+func ownedResources(iop *unstructured.Unstructured) ([]OwnedResourceRef, error) {
+	raw, ok := iop.GetAnnotations()[OwnedResourcesAnnotation]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+	var refs []OwnedResourceRef
+	if err := json.Unmarshal([]byte(raw), &refs); err != nil {
+		return nil, fmt.Errorf("failed to decode owned-resources inventory: %v", err)
+	}
+	return refs, nil
+}
+
+func isNotFound(err error) bool {
+	return apierrors.IsNotFound(err)
+}
+
+func gvrForKind(kind string) (schema.GroupVersionResource, bool) {
+	switch kind {
+	case "MutatingWebhookConfiguration":
+		return schema.GroupVersionResource{Group: "admissionregistration.k8s.io", Version: "v1", Resource: "mutatingwebhookconfigurations"}, true
+	case "ValidatingWebhookConfiguration":
+		return schema.GroupVersionResource{Group: "admissionregistration.k8s.io", Version: "v1", Resource: "validatingwebhookconfigurations"}, true
+	case "EnvoyFilter":
+		return schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1alpha3", Resource: "envoyfilters"}, true
+	case "Deployment":
+		return schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, true
+	case "Service":
+		return schema.GroupVersionResource{Group: "", Version: "v1", Resource: "services"}, true
+	case "ServiceAccount":
+		return schema.GroupVersionResource{Group: "", Version: "v1", Resource: "serviceaccounts"}, true
+	case "ConfigMap":
+		return schema.GroupVersionResource{Group: "", Version: "v1", Resource: "configmaps"}, true
+	case "ClusterRole":
+		return schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}, true
+	case "ClusterRoleBinding":
+		return schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterrolebindings"}, true
+	case "Role":
+		return schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "roles"}, true
+	case "RoleBinding":
+		return schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "rolebindings"}, true
+	case "PodDisruptionBudget":
+		return schema.GroupVersionResource{Group: "policy", Version: "v1beta1", Resource: "poddisruptionbudgets"}, true
+	case "HorizontalPodAutoscaler":
+		return schema.GroupVersionResource{Group: "autoscaling", Version: "v2beta2", Resource: "horizontalpodautoscalers"}, true
+	case "CustomResourceDefinition":
+		return schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}, true
+	default:
+		return schema.GroupVersionResource{}, false
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"istio.io/istio/operator/pkg/controller"
+	"istio.io/istio/operator/pkg/util"
+	"istio.io/istio/pkg/test/framework"
+	"istio.io/istio/pkg/test/framework/components/environment/kube"
+	"istio.io/istio/pkg/test/framework/components/istioctl"
+	"istio.io/istio/pkg/test/framework/image"
+	"istio.io/istio/pkg/test/framework/resource"
+	"istio.io/istio/pkg/test/framework/resource/environment"
+	"istio.io/istio/pkg/test/scopes"
+)
+
+// bundledCharts maps a bundle component name to the chart directory under ManifestPath whose
+// content is pinned, mirroring the component set manifests/ installs today.
+var bundledCharts = map[string]string{
+	"base":     "charts/base",
+	"pilot":    "charts/istio-control/istio-discovery",
+	"ingress":  "charts/gateways/istio-ingress",
+	"egress":   "charts/gateways/istio-egress",
+	"cni":      "charts/istio-cni",
+	"operator": "charts/istio-operator",
+}
+
+// bundledImages maps a bundle component name to the image name built for it, so the component
+// images referenced in spec.bundleManifest.images resolve against the same hub/tag the test run
+// is already using.
+var bundledImages = map[string]string{
+	"pilot":    "pilot",
+	"proxy":    "proxyv2",
+	"cni":      "install-cni",
+	"operator": "operator",
+}
+
+// TestControllerBundleManifest installs from a spec.bundleManifest that pins the chart bundle
+// to local file:// URLs instead of installPackagePath, and verifies the rendered manifests
+// match what the controller actually installs.
+func TestControllerBundleManifest(t *testing.T) {
+	framework.
+		NewTest(t).
+		RequiresEnvironment(environment.Kube).
+		Run(func(ctx framework.TestContext) {
+			istioCtl := istioctl.NewOrFail(ctx, ctx, istioctl.Config{})
+			workDir, err := ctx.CreateTmpDirectory("operator-bundle-manifest-test")
+			if err != nil {
+				t.Fatal("failed to create test directory")
+			}
+			cs := ctx.Environment().(*kube.Environment).KubeClusters[0]
+			s, err := image.SettingsFromCommandLine()
+			if err != nil {
+				t.Fatal(err)
+			}
+			initCmd := []string{
+				"operator", "init",
+				"--wait",
+				"--hub=" + s.Hub,
+				"--tag=" + s.Tag,
+				"--charts=" + ManifestPath,
+			}
+			istioCtl.InvokeOrFail(t, initCmd)
+
+			if err := cs.CreateNamespace(IstioNamespace, ""); err != nil {
+				if _, getErr := cs.GetNamespace(IstioNamespace); getErr != nil {
+					t.Errorf("failed to create istio namespace: %v", err)
+				}
+			}
+
+			iopFile := installWithBundleManifest(t, ctx, cs, istioCtl, workDir, path.Join(ProfilesPath, "default.yaml"), s)
+			if err := compareInClusterAndGeneratedResources(t, istioCtl, iopFile, cs); err != nil {
+				t.Fatalf("in cluster resources do not match bundle-manifest generated ones: %v", err)
+			}
+		})
+}
+
+// installWithBundleManifest writes a bundle manifest referencing ManifestPath via local file://
+// URLs, applies an IstioOperator CR that sets spec.bundleManifest to it (with no
+// installPackagePath — the bundle is the sole chart source once set), and verifies the
+// installation the same way installWithCRFile does.
+func installWithBundleManifest(t *testing.T, ctx resource.Context, cs kube.Cluster,
+	istioCtl istioctl.Instance, workDir, iopFile string, s *image.Settings) string {
+	t.Helper()
+	scopes.CI.Infof("=== install istio with bundle manifest derived from: %s===\n", iopFile)
+
+	bundleFile := writeLocalBundleManifest(t, workDir, s)
+
+	originalIOPYAML, err := ioutil.ReadFile(iopFile)
+	if err != nil {
+		t.Fatalf("failed to read iop file: %v", err)
+	}
+	metadataYAML := `
+metadata:
+  name: test-istiocontrolplane
+  namespace: istio-system
+spec:
+  bundleManifest: %s
+`
+	overlayYAML := fmt.Sprintf(metadataYAML, bundleFile)
+	iopcr, err := util.OverlayYAML(string(originalIOPYAML), overlayYAML)
+	if err != nil {
+		t.Fatalf("failed to overlay iop with bundleManifest: %v", err)
+	}
+	iopCRFile := filepath.Join(workDir, "iop_bundle_cr.yaml")
+	if err := ioutil.WriteFile(iopCRFile, []byte(iopcr), os.ModePerm); err != nil {
+		t.Fatalf("failed to write iop cr file: %v", err)
+	}
+
+	if err := cs.Apply(IstioNamespace, iopCRFile); err != nil {
+		t.Fatalf("failed to apply IstioOperator CR file: %s, %v", iopCRFile, err)
+	}
+	verifyInstallation(t, ctx, istioCtl, iopFile, cs)
+	return iopCRFile
+}
+
+// writeLocalBundleManifest renders a controller.BundleManifest pointing every chart at a
+// file:// URL under ManifestPath, pinned via controller.PinChartDir against that chart
+// directory's actual content — the same directory the URL resolves to, so
+// controller.FetchChart can verify it byte-for-byte — and writes it to workDir.
+func writeLocalBundleManifest(t *testing.T, workDir string, s *image.Settings) string {
+	t.Helper()
+	bm := controller.BundleManifest{
+		Charts: make(map[string]controller.BundleArtifact, len(bundledCharts)),
+		Images: make(map[string]controller.BundleArtifact, len(bundledImages)),
+	}
+	for name, rel := range bundledCharts {
+		chartDir := filepath.Join(ManifestPath, rel)
+		artifact, err := controller.PinChartDir(chartDir)
+		if err != nil {
+			t.Fatalf("failed to pin chart %s: %v", name, err)
+		}
+		bm.Charts[name] = artifact
+	}
+	for name, imageName := range bundledImages {
+		// Component images are pulled by kubelet against the registry's own content
+		// digest embedded in the reference, not fetched/verified by the controller the
+		// way charts are, so no local sha256 pin applies here; the test run's hub/tag
+		// is enough to identify which build each component should use.
+		bm.Images[name] = controller.BundleArtifact{
+			URL: fmt.Sprintf("%s/%s:%s", s.Hub, imageName, s.Tag),
+		}
+	}
+
+	out, err := yaml.Marshal(bm)
+	if err != nil {
+		t.Fatalf("failed to marshal bundle manifest: %v", err)
+	}
+	bundleFile := filepath.Join(workDir, "bundle_manifest.yaml")
+	if err := ioutil.WriteFile(bundleFile, out, os.ModePerm); err != nil {
+		t.Fatalf("failed to write bundle manifest file: %v", err)
+	}
+	return bundleFile
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"istio.io/istio/operator/pkg/controller"
+	"istio.io/istio/operator/pkg/util"
+	"istio.io/istio/pkg/test/framework"
+	"istio.io/istio/pkg/test/framework/components/environment/kube"
+	"istio.io/istio/pkg/test/framework/components/istioctl"
+	"istio.io/istio/pkg/test/framework/image"
+	"istio.io/istio/pkg/test/framework/resource"
+	"istio.io/istio/pkg/test/framework/resource/environment"
+	"istio.io/istio/pkg/test/scopes"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+const (
+	canaryRevisionOld = "1-x"
+	canaryRevisionNew = "1-y"
+)
+
+var mutatingWebhookGVR = schema.GroupVersionResource{
+	Group:    "admissionregistration.k8s.io",
+	Version:  "v1",
+	Resource: "mutatingwebhookconfigurations",
+}
+
+// TestControllerRevisionCanary installs two revisions of the control plane side by side under
+// distinct IstioOperator CRs, then flips the "default" tag from the old revision to the new one
+// and verifies the MutatingWebhookConfiguration selector, ComponentStatus, and echo traffic all
+// follow the tag switch.
+func TestControllerRevisionCanary(t *testing.T) {
+	framework.
+		NewTest(t).
+		RequiresEnvironment(environment.Kube).
+		Run(func(ctx framework.TestContext) {
+			istioCtl := istioctl.NewOrFail(ctx, ctx, istioctl.Config{})
+			workDir, err := ctx.CreateTmpDirectory("operator-canary-test")
+			if err != nil {
+				t.Fatal("failed to create test directory")
+			}
+			cs := ctx.Environment().(*kube.Environment).KubeClusters[0]
+			s, err := image.SettingsFromCommandLine()
+			if err != nil {
+				t.Fatal(err)
+			}
+			initCmd := []string{
+				"operator", "init",
+				"--wait",
+				"--hub=" + s.Hub,
+				"--tag=" + s.Tag,
+				"--charts=" + ManifestPath,
+			}
+			istioCtl.InvokeOrFail(t, initCmd)
+
+			if err := cs.CreateNamespace(IstioNamespace, ""); err != nil {
+				if _, getErr := cs.GetNamespace(IstioNamespace); getErr != nil {
+					t.Errorf("failed to create istio namespace: %v", err)
+				}
+			}
+
+			installWithRevisionCR(t, ctx, cs, istioCtl, workDir, path.Join(ProfilesPath, "default.yaml"), canaryRevisionOld, "default")
+			installWithRevisionCR(t, ctx, cs, istioCtl, workDir, path.Join(ProfilesPath, "demo.yaml"), canaryRevisionNew, "demo")
+
+			for _, rev := range []string{canaryRevisionOld, canaryRevisionNew} {
+				deploymentName := "istiod-" + rev
+				if _, err := cs.GetDeployment(IstioNamespace, deploymentName); err != nil {
+					t.Fatalf("expected istiod deployment %s to exist alongside the other revision: %v", deploymentName, err)
+				}
+			}
+
+			// Promote canaryRevisionOld by setting spec.tag on its CR; the controller
+			// (controller.ReconcileTag) reconciles the "istio-revision-tag-default"
+			// MutatingWebhookConfiguration's selector to match accordingly.
+			setTagViaCR(t, cs, workDir, path.Join(ProfilesPath, "default.yaml"), canaryRevisionOld, "default", "default")
+			assertTagPointsToRevision(t, cs, "default", canaryRevisionOld)
+
+			// Demote canaryRevisionOld and promote canaryRevisionNew by moving spec.tag
+			// from the old CR to the new one.
+			setTagViaCR(t, cs, workDir, path.Join(ProfilesPath, "default.yaml"), canaryRevisionOld, "default", "")
+			setTagViaCR(t, cs, workDir, path.Join(ProfilesPath, "demo.yaml"), canaryRevisionNew, "demo", "default")
+			assertTagPointsToRevision(t, cs, "default", canaryRevisionNew)
+
+			if err := checkInstallStatus(cs); err != nil {
+				t.Fatalf("IstioOperator status not healthy after tag switch: %v", err)
+			}
+			sanityCheck(t, ctx)
+		})
+}
+
+// installWithRevisionCR installs an IstioOperator CR pinned to a specific revision.
+func installWithRevisionCR(t *testing.T, ctx resource.Context, cs kube.Cluster,
+	istioCtl istioctl.Instance, workDir, iopFile, revision, crNameSuffix string) {
+	t.Helper()
+	scopes.CI.Infof("=== install istio revision %s from cr file: %s===\n", revision, iopFile)
+	originalIOPYAML, err := ioutil.ReadFile(iopFile)
+	if err != nil {
+		t.Fatalf("failed to read iop file: %v", err)
+	}
+	metadataYAML := `
+metadata:
+  name: test-istiocontrolplane-%s
+  namespace: istio-system
+spec:
+  revision: %s
+  installPackagePath: %s
+`
+	overlayYAML := fmt.Sprintf(metadataYAML, crNameSuffix, revision, ManifestPathContainer)
+	iopcr, err := util.OverlayYAML(string(originalIOPYAML), overlayYAML)
+	if err != nil {
+		t.Fatalf("failed to overlay iop with revision metadata: %v", err)
+	}
+	iopCRFile := filepath.Join(workDir, fmt.Sprintf("iop_cr_%s.yaml", crNameSuffix))
+	if err := ioutil.WriteFile(iopCRFile, []byte(iopcr), os.ModePerm); err != nil {
+		t.Fatalf("failed to write iop cr file: %v", err)
+	}
+
+	if err := cs.Apply(IstioNamespace, iopCRFile); err != nil {
+		t.Fatalf("failed to apply IstioOperator CR file: %s, %v", iopCRFile, err)
+	}
+	verifyInstallation(t, ctx, istioCtl, iopFile, cs)
+}
+
+// setTagViaCR re-applies an IstioOperator CR with spec.tag set (or cleared, when tag is empty),
+// which is the CR-driven mechanism controller.ReconcileTag watches for: promoting/demoting a
+// revision tag never touches the MutatingWebhookConfiguration directly, only the CR.
+func setTagViaCR(t *testing.T, cs kube.Cluster, workDir, iopFile, revision, crNameSuffix, tag string) {
+	t.Helper()
+	originalIOPYAML, err := ioutil.ReadFile(iopFile)
+	if err != nil {
+		t.Fatalf("failed to read iop file: %v", err)
+	}
+	metadataYAML := `
+metadata:
+  name: test-istiocontrolplane-%s
+  namespace: istio-system
+spec:
+  revision: %s
+  tag: %q
+  installPackagePath: %s
+`
+	overlayYAML := fmt.Sprintf(metadataYAML, crNameSuffix, revision, tag, ManifestPathContainer)
+	iopcr, err := util.OverlayYAML(string(originalIOPYAML), overlayYAML)
+	if err != nil {
+		t.Fatalf("failed to overlay iop with tag metadata: %v", err)
+	}
+	iopCRFile := filepath.Join(workDir, fmt.Sprintf("iop_cr_%s.yaml", crNameSuffix))
+	if err := ioutil.WriteFile(iopCRFile, []byte(iopcr), os.ModePerm); err != nil {
+		t.Fatalf("failed to write iop cr file: %v", err)
+	}
+	if err := cs.Apply(IstioNamespace, iopCRFile); err != nil {
+		t.Fatalf("failed to apply IstioOperator CR file: %s, %v", iopCRFile, err)
+	}
+}
+
+// assertTagPointsToRevision verifies the MutatingWebhookConfiguration for the given tag
+// selects the expected revision after a tag switch, reading the live object via the generic
+// unstructured accessor rather than a bespoke kube.Cluster method.
+func assertTagPointsToRevision(t *testing.T, cs kube.Cluster, tag, revision string) {
+	t.Helper()
+	webhookName := "istio-revision-tag-" + tag
+	retry.UntilSuccessOrFail(t, func() error {
+		if exist := cs.MutatingWebhookConfigurationExists(webhookName); !exist {
+			return fmt.Errorf("mutatingwebhookconfiguration %s does not exist", webhookName)
+		}
+		us, err := cs.GetUnstructured(mutatingWebhookGVR, "", webhookName)
+		if err != nil {
+			return fmt.Errorf("failed to get MutatingWebhookConfiguration %s: %v", webhookName, err)
+		}
+		selectedRevision, err := revisionFromWebhookSelector(us.UnstructuredContent())
+		if err != nil {
+			return fmt.Errorf("failed to read revision selector from %s: %v", webhookName, err)
+		}
+		if selectedRevision != revision {
+			return fmt.Errorf("webhook %s selects revision %s, want %s", webhookName, selectedRevision, revision)
+		}
+		return nil
+	}, retry.Timeout(retryTimeOut), retry.Delay(retryDelay))
+}
+
+// revisionFromWebhookSelector extracts the istio.io/rev match expression value that
+// controller.ReconcileTag writes into the webhook's namespaceSelector/objectSelector.
+func revisionFromWebhookSelector(webhook map[string]interface{}) (string, error) {
+	webhooks, ok := webhook["webhooks"].([]interface{})
+	if !ok || len(webhooks) == 0 {
+		return "", fmt.Errorf("malformed MutatingWebhookConfiguration: no webhooks[]")
+	}
+	for _, w := range webhooks {
+		wh, ok := w.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, selectorKey := range []string{"namespaceSelector", "objectSelector"} {
+			selector, ok := wh[selectorKey].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			exprs, ok := selector["matchExpressions"].([]interface{})
+			if !ok {
+				continue
+			}
+			for _, e := range exprs {
+				expr, ok := e.(map[string]interface{})
+				if !ok || expr["key"] != controller.RevisionLabel {
+					continue
+				}
+				values, ok := expr["values"].([]interface{})
+				if !ok || len(values) == 0 {
+					continue
+				}
+				if v, ok := values[0].(string); ok {
+					return v, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("no %s match expression found", controller.RevisionLabel)
+}
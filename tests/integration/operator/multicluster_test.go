@@ -0,0 +1,253 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"istio.io/istio/operator/pkg/util"
+	"istio.io/istio/pkg/config/protocol"
+	"istio.io/istio/pkg/test/framework"
+	"istio.io/istio/pkg/test/framework/components/echo"
+	"istio.io/istio/pkg/test/framework/components/echo/echoboot"
+	"istio.io/istio/pkg/test/framework/components/environment/kube"
+	"istio.io/istio/pkg/test/framework/components/istioctl"
+	"istio.io/istio/pkg/test/framework/components/namespace"
+	"istio.io/istio/pkg/test/framework/image"
+	"istio.io/istio/pkg/test/framework/resource"
+	"istio.io/istio/pkg/test/framework/resource/environment"
+	"istio.io/istio/pkg/test/scopes"
+	"istio.io/istio/pkg/test/util/retry"
+	"istio.io/pkg/log"
+)
+
+// primaryClusterName and remoteClusterName identify the two clusters in spec.clusterProfiles.
+// kube.Cluster has no Name() accessor, so this test picks the names itself rather than deriving
+// them from the cluster, and threads them alongside each kube.Cluster wherever one is needed.
+const (
+	primaryClusterName = "primary"
+	remoteClusterName  = "remote"
+)
+
+// TestControllerMultiPrimary installs a single IstioOperator CR whose spec.clusterProfiles
+// references two clusters and verifies the controller fans the install out to both, rolling
+// up per-cluster status under status.clusterStatus, then confirms cross-cluster traffic works
+// through the east-west gateway.
+func TestControllerMultiPrimary(t *testing.T) {
+	framework.
+		NewTest(t).
+		RequiresEnvironment(environment.Kube).
+		Run(func(ctx framework.TestContext) {
+			kubeEnv := ctx.Environment().(*kube.Environment)
+			if len(kubeEnv.KubeClusters) < 2 {
+				t.Skip("test requires at least two clusters")
+			}
+			primary, remote := kubeEnv.KubeClusters[0], kubeEnv.KubeClusters[1]
+
+			istioCtl := istioctl.NewOrFail(ctx, ctx, istioctl.Config{})
+			workDir, err := ctx.CreateTmpDirectory("operator-multiprimary-test")
+			if err != nil {
+				t.Fatal("failed to create test directory")
+			}
+			s, err := image.SettingsFromCommandLine()
+			if err != nil {
+				t.Fatal(err)
+			}
+			initCmd := []string{
+				"operator", "init",
+				"--wait",
+				"--hub=" + s.Hub,
+				"--tag=" + s.Tag,
+				"--charts=" + ManifestPath,
+			}
+			istioCtl.InvokeOrFail(t, initCmd)
+
+			for _, cs := range []kube.Cluster{primary, remote} {
+				if err := cs.CreateNamespace(IstioNamespace, ""); err != nil {
+					if _, getErr := cs.GetNamespace(IstioNamespace); getErr == nil {
+						log.Info("istio namespace already exist")
+					} else {
+						t.Errorf("failed to create istio namespace: %v", err)
+					}
+				}
+			}
+
+			iopFile := installMultiPrimaryCR(t, ctx, workDir, primary, remote, "demo")
+
+			clusters := []struct {
+				cs   kube.Cluster
+				name string
+			}{
+				{primary, primaryClusterName},
+				{remote, remoteClusterName},
+			}
+			for _, c := range clusters {
+				// The IstioOperator CR (and its rolled-up status.clusterStatus) only exists on
+				// primary, since installMultiPrimaryCR only applies it there; remote's own
+				// apiserver never gets one, so this always reads primary regardless of which
+				// cluster's entry we're checking.
+				if err := checkInstallStatusForCluster(primary, c.name); err != nil {
+					t.Fatalf("IstioOperator status for cluster %s not healthy: %v", c.name, err)
+				}
+				if _, err := c.cs.CheckPodsAreReady(c.cs.NewPodFetch(IstioNamespace)); err != nil {
+					t.Fatalf("pods are not ready on cluster %s: %v", c.name, err)
+				}
+				if err := compareInClusterAndGeneratedResources(t, istioCtl, iopFile, c.cs); err != nil {
+					t.Fatalf("in cluster resources on %s do not match generated ones: %v", c.name, err)
+				}
+			}
+
+			crossClusterSanityCheck(t, ctx, primary, remote)
+		})
+}
+
+// installMultiPrimaryCR writes a single IstioOperator CR referencing both clusters'
+// kubeconfig secrets via spec.clusterProfiles and applies it to the primary cluster.
+func installMultiPrimaryCR(t *testing.T, ctx resource.Context, workDir string,
+	primary, remote kube.Cluster, profile string) string {
+	t.Helper()
+	clusterProfilesYAML := `
+metadata:
+  name: test-istiocontrolplane
+  namespace: istio-system
+spec:
+  installPackagePath: %s
+  clusterProfiles:
+  - clusterName: %s
+    network: network-1
+    meshID: mesh-1
+    kubeconfigSecret: %s-kubeconfig
+  - clusterName: %s
+    network: network-2
+    meshID: mesh-1
+    kubeconfigSecret: %s-kubeconfig
+`
+	overlayYAML := fmt.Sprintf(clusterProfilesYAML, ManifestPathContainer,
+		primaryClusterName, primaryClusterName, remoteClusterName, remoteClusterName)
+
+	profileFile := filepath.Join(ProfilesPath, profile+".yaml")
+	originalIOPYAML, err := ioutil.ReadFile(profileFile)
+	if err != nil {
+		t.Fatalf("failed to read iop file: %v", err)
+	}
+	iopcr, err := util.OverlayYAML(string(originalIOPYAML), overlayYAML)
+	if err != nil {
+		t.Fatalf("failed to overlay iop with cluster profiles: %v", err)
+	}
+	iopCRFile := filepath.Join(workDir, "iop_multiprimary_cr.yaml")
+	if err := ioutil.WriteFile(iopCRFile, []byte(iopcr), os.ModePerm); err != nil {
+		t.Fatalf("failed to write iop cr file: %v", err)
+	}
+
+	if err := primary.Apply(IstioNamespace, iopCRFile); err != nil {
+		t.Fatalf("failed to apply multi-primary IstioOperator CR file: %s, %v", iopCRFile, err)
+	}
+	return iopCRFile
+}
+
+// checkInstallStatusForCluster checks the status.clusterStatus entry for a single cluster
+// within the aggregated IstioOperator status.
+//
+// status.clusterStatus is written by controller.ReconcileMultiPrimary (operator/pkg/controller)
+// directly as a nested map, not as a field on the proto-defined api.InstallStatus message, so
+// it's read here off the unstructured object rather than jsonpb-unmarshaled into api.InstallStatus.
+func checkInstallStatusForCluster(cs kube.Cluster, clusterName string) error {
+	scopes.CI.Infof("checking IstioOperator clusterStatus for cluster %s", clusterName)
+	gvr := schema.GroupVersionResource{
+		Group:    "install.istio.io",
+		Version:  "v1alpha1",
+		Resource: "istiooperators",
+	}
+
+	retryFunc := func() error {
+		us, err := cs.GetUnstructured(gvr, IstioNamespace, "test-istiocontrolplane")
+		if err != nil {
+			return fmt.Errorf("failed to get istioOperator resource: %v", err)
+		}
+		status, ok := us.UnstructuredContent()["status"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("status not found from the istioOperator resource")
+		}
+		clusterStatuses, ok := status["clusterStatus"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("status.clusterStatus not found from the istioOperator resource")
+		}
+		clusterStatus, ok := clusterStatuses[clusterName].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("no clusterStatus entry for cluster %s", clusterName)
+		}
+		if got := clusterStatus["status"]; got != "HEALTHY" {
+			return fmt.Errorf("cluster %s status: %v", clusterName, got)
+		}
+		components, _ := clusterStatus["componentStatus"].(map[string]interface{})
+		for cn, raw := range components {
+			cnstatus, ok := raw.(map[string]interface{})
+			if !ok || cnstatus["status"] != "HEALTHY" {
+				return fmt.Errorf("cluster %s component %s status: %v", clusterName, cn, raw)
+			}
+		}
+		return nil
+	}
+	return retry.UntilSuccess(retryFunc, retry.Timeout(retryTimeOut), retry.Delay(retryDelay))
+}
+
+// crossClusterSanityCheck deploys an echo client in the primary cluster and an echo server in
+// the remote cluster and verifies traffic crosses the east-west gateway successfully.
+func crossClusterSanityCheck(t *testing.T, ctx resource.Context, primary, remote kube.Cluster) {
+	var client, server echo.Instance
+	clientNs := namespace.NewOrFail(t, ctx, namespace.Config{
+		Prefix: "cross-cluster-client",
+		Inject: true,
+	})
+	serverNs := namespace.NewOrFail(t, ctx, namespace.Config{
+		Prefix: "cross-cluster-server",
+		Inject: true,
+	})
+	echoboot.NewBuilderOrFail(t, ctx).
+		With(&client, echo.Config{
+			Service:   "client",
+			Namespace: clientNs,
+			Cluster:   primary,
+			Ports:     []echo.Port{},
+		}).
+		With(&server, echo.Config{
+			Service:   "server",
+			Namespace: serverNs,
+			Cluster:   remote,
+			Ports: []echo.Port{
+				{
+					Name:         "http",
+					Protocol:     protocol.HTTP,
+					InstancePort: 8090,
+				}},
+		}).
+		BuildOrFail(t)
+	retry.UntilSuccessOrFail(t, func() error {
+		resp, err := client.Call(echo.CallOptions{
+			Target:   server,
+			PortName: "http",
+		})
+		if err != nil {
+			return err
+		}
+		return resp.CheckOK()
+	}, retry.Delay(retryDelay), retry.Timeout(retryTimeOut))
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operator
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"istio.io/istio/operator/pkg/object"
+	"istio.io/istio/pkg/test/framework"
+	"istio.io/istio/pkg/test/framework/components/environment/kube"
+	"istio.io/istio/pkg/test/framework/components/istioctl"
+	"istio.io/istio/pkg/test/framework/image"
+	"istio.io/istio/pkg/test/framework/resource/environment"
+	"istio.io/istio/pkg/test/scopes"
+	"istio.io/istio/pkg/test/shell"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// crdGVR addresses CustomResourceDefinitions, which ownedResourceExists fetches generically via
+// GetUnstructured.
+var crdGVR = schema.GroupVersionResource{
+	Group:    "apiextensions.k8s.io",
+	Version:  "v1",
+	Resource: "customresourcedefinitions",
+}
+
+// efgvr addresses EnvoyFilters, fetched generically via GetUnstructured since kube.Cluster has
+// no typed EnvoyFilter accessor, matching compareInClusterAndGeneratedResources.
+var efgvr = schema.GroupVersionResource{
+	Group:    "networking.istio.io",
+	Version:  "v1alpha3",
+	Resource: "envoyfilters",
+}
+
+// TestControllerDriftRevert installs istio, manually scales up the istiod Deployment by one to
+// simulate drift, and verifies the controller's continuous drift detection reverts the
+// replica count back to the generated manifest's value.
+func TestControllerDriftRevert(t *testing.T) {
+	framework.
+		NewTest(t).
+		RequiresEnvironment(environment.Kube).
+		Run(func(ctx framework.TestContext) {
+			istioCtl := istioctl.NewOrFail(ctx, ctx, istioctl.Config{})
+			workDir, err := ctx.CreateTmpDirectory("operator-drift-test")
+			if err != nil {
+				t.Fatal("failed to create test directory")
+			}
+			cs := ctx.Environment().(*kube.Environment).KubeClusters[0]
+			s, err := image.SettingsFromCommandLine()
+			if err != nil {
+				t.Fatal(err)
+			}
+			initCmd := []string{
+				"operator", "init",
+				"--wait",
+				"--hub=" + s.Hub,
+				"--tag=" + s.Tag,
+				"--charts=" + ManifestPath,
+			}
+			istioCtl.InvokeOrFail(t, initCmd)
+
+			if err := cs.CreateNamespace(IstioNamespace, ""); err != nil {
+				if _, getErr := cs.GetNamespace(IstioNamespace); getErr != nil {
+					t.Errorf("failed to create istio namespace: %v", err)
+				}
+			}
+
+			iopFile := path.Join(ProfilesPath, "default.yaml")
+			installWithCRFile(t, ctx, cs, istioCtl, workDir, iopFile)
+
+			wantReplicas, err := getDeploymentReplicas(cs, "istiod")
+			if err != nil {
+				t.Fatalf("failed to read istiod replica count: %v", err)
+			}
+
+			if err := scaleDeployment("istiod", wantReplicas+1); err != nil {
+				t.Fatalf("failed to mutate istiod replicas to induce drift: %v", err)
+			}
+
+			retry.UntilSuccessOrFail(t, func() error {
+				got, err := getDeploymentReplicas(cs, "istiod")
+				if err != nil {
+					return err
+				}
+				if got != wantReplicas {
+					return fmt.Errorf("istiod replicas = %d, want controller to revert to %d", got, wantReplicas)
+				}
+				return nil
+			}, retry.Timeout(retryTimeOut), retry.Delay(retryDelay))
+
+			if err := assertNoDrift(cs); err != nil {
+				t.Fatalf("status.drift not empty after revert: %v", err)
+			}
+		})
+}
+
+// TestControllerUninstall deletes the IstioOperator CR and confirms the controller tears down
+// every resource enumerated by compareInClusterAndGeneratedResources within retryTimeOut,
+// blocking finalizer removal until the teardown verification succeeds.
+func TestControllerUninstall(t *testing.T) {
+	framework.
+		NewTest(t).
+		RequiresEnvironment(environment.Kube).
+		Run(func(ctx framework.TestContext) {
+			istioCtl := istioctl.NewOrFail(ctx, ctx, istioctl.Config{})
+			workDir, err := ctx.CreateTmpDirectory("operator-uninstall-test")
+			if err != nil {
+				t.Fatal("failed to create test directory")
+			}
+			cs := ctx.Environment().(*kube.Environment).KubeClusters[0]
+			s, err := image.SettingsFromCommandLine()
+			if err != nil {
+				t.Fatal(err)
+			}
+			initCmd := []string{
+				"operator", "init",
+				"--wait",
+				"--hub=" + s.Hub,
+				"--tag=" + s.Tag,
+				"--charts=" + ManifestPath,
+			}
+			istioCtl.InvokeOrFail(t, initCmd)
+
+			if err := cs.CreateNamespace(IstioNamespace, ""); err != nil {
+				if _, getErr := cs.GetNamespace(IstioNamespace); getErr != nil {
+					t.Errorf("failed to create istio namespace: %v", err)
+				}
+			}
+
+			iopFile := path.Join(ProfilesPath, "default.yaml")
+			installWithCRFile(t, ctx, cs, istioCtl, workDir, iopFile)
+
+			// This test exercises the default preserveCRDs=false path, where CRDs are pruned
+			// last rather than preserved, so they must stay in the expected-absent set;
+			// otherwise a regression that stops deleting CRDs would go uncaught.
+			ownedObjects := generatedObjects(t, istioCtl, iopFile, false)
+
+			if err := deleteIstioOperatorCR("test-istiocontrolplane"); err != nil {
+				t.Fatalf("failed to delete IstioOperator CR: %v", err)
+			}
+
+			retry.UntilSuccessOrFail(t, func() error {
+				for _, obj := range ownedObjects {
+					if ownedResourceExists(cs, obj) {
+						return fmt.Errorf("owned resource kind: %s, namespace: %s, name: %s still exists", obj.Kind, obj.Namespace, obj.Name)
+					}
+				}
+				return nil
+			}, retry.Timeout(retryTimeOut), retry.Delay(retryDelay))
+		})
+}
+
+// generatedObjects returns the k8s objects rendered from the given IOP file, which the
+// controller is expected to have recorded in the install.istio.io/owned-resources inventory
+// annotation at install time. CRDs are excluded only when preserveCRDs is true, matching
+// controller.Uninstall's own preserveCRDs gating.
+func generatedObjects(t *testing.T, istioCtl istioctl.Instance, iopFile string, preserveCRDs bool) []object.K8sObject {
+	t.Helper()
+	generateCmd := []string{
+		"manifest", "generate",
+		"--charts", ManifestPath,
+		"-f", iopFile,
+	}
+	genManifests := istioCtl.InvokeOrFail(t, generateCmd)
+	objs, err := object.ParseK8sObjectsFromYAMLManifest(genManifests)
+	if err != nil {
+		t.Fatalf("failed to parse generated manifest: %v", err)
+	}
+	var owned []object.K8sObject
+	for _, o := range objs {
+		if o.Kind == "CustomResourceDefinition" && preserveCRDs {
+			continue
+		}
+		owned = append(owned, *o)
+	}
+	return owned
+}
+
+// ownedResourceExists reports whether a previously-generated object is still present in the
+// cluster, used to confirm the uninstall path prunes owned resources. It checks the same kinds
+// compareInClusterAndGeneratedResources does; any other kind (e.g. the RBAC kinds) is reported
+// as absent without a lookup.
+func ownedResourceExists(cs kube.Cluster, obj object.K8sObject) bool {
+	switch obj.Kind {
+	case "Deployment":
+		_, err := cs.GetDeployment(IstioNamespace, obj.Name)
+		return err == nil
+	case "Service":
+		_, err := cs.GetService(obj.Namespace, obj.Name)
+		return err == nil
+	case "ServiceAccount":
+		_, err := cs.GetServiceAccount(obj.Namespace, obj.Name)
+		return err == nil
+	case "ConfigMap":
+		_, err := cs.GetConfigMap(obj.Name, obj.Namespace)
+		return err == nil
+	case "MutatingWebhookConfiguration":
+		return cs.MutatingWebhookConfigurationExists(obj.Name)
+	case "ValidatingWebhookConfiguration":
+		return cs.ValidatingWebhookConfigurationExists(obj.Name)
+	case "EnvoyFilter":
+		_, err := cs.GetUnstructured(efgvr, obj.Namespace, obj.Name)
+		return err == nil
+	case "PodDisruptionBudget":
+		_, err := cs.GetPodDisruptionBudget(obj.Namespace, obj.Name)
+		return err == nil
+	case "HorizontalPodAutoscaler":
+		_, err := cs.GetHorizontalPodAutoscaler(obj.Namespace, obj.Name)
+		return err == nil
+	case "CustomResourceDefinition":
+		_, err := cs.GetUnstructured(crdGVR, "", obj.Name)
+		return err == nil
+	default:
+		return false
+	}
+}
+
+// deleteIstioOperatorCR deletes the named IstioOperator CR, triggering the controller's
+// full-teardown deletion path (controller.Uninstall). kube.Cluster exposes no generic delete
+// helper, so this falls back to kubectl directly, the same way checkInstallStatus falls back to
+// `kubectl logs` for diagnostics it has no typed accessor for.
+func deleteIstioOperatorCR(name string) error {
+	_, err := shell.Execute(false, "kubectl delete istiooperator -n %s %s", IstioNamespace, name)
+	return err
+}
+
+// getDeploymentReplicas returns the current replica count of the named Deployment.
+func getDeploymentReplicas(cs kube.Cluster, name string) (int32, error) {
+	dep, err := cs.GetDeployment(IstioNamespace, name)
+	if err != nil {
+		return 0, err
+	}
+	if dep.Spec.Replicas == nil {
+		return 0, fmt.Errorf("deployment %s has no replica count set", name)
+	}
+	return *dep.Spec.Replicas, nil
+}
+
+// scaleDeployment patches the named Deployment's replica count, used to simulate out-of-band
+// drift for TestControllerDriftRevert. kube.Cluster has no scale helper, so this shells out to
+// kubectl the same way deleteIstioOperatorCR does.
+func scaleDeployment(name string, replicas int32) error {
+	_, err := shell.Execute(false, "kubectl scale deployment -n %s %s --replicas=%d", IstioNamespace, name, replicas)
+	return err
+}
+
+// assertNoDrift checks that status.drift on the IstioOperator CR is empty, meaning the
+// controller has reconciled away any detected drift.
+func assertNoDrift(cs kube.Cluster) error {
+	scopes.CI.Infof("checking IstioOperator status.drift is empty")
+	gvr := schema.GroupVersionResource{
+		Group:    "install.istio.io",
+		Version:  "v1alpha1",
+		Resource: "istiooperators",
+	}
+	us, err := cs.GetUnstructured(gvr, IstioNamespace, "test-istiocontrolplane")
+	if err != nil {
+		return fmt.Errorf("failed to get istioOperator resource: %v", err)
+	}
+	status, ok := us.UnstructuredContent()["status"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("status not found from the istioOperator resource")
+	}
+	if drift, ok := status["drift"].([]interface{}); ok && len(drift) > 0 {
+		return fmt.Errorf("expected status.drift to be empty, got: %v", drift)
+	}
+	return nil
+}